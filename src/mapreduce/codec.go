@@ -0,0 +1,96 @@
+package mapreduce
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"io"
+)
+
+// KVWriter serializes KeyValue records to an underlying stream. Close
+// flushes and finalizes the stream (important for codecs that buffer) but
+// does not close the underlying io.Writer.
+type KVWriter interface {
+	Write(kv KeyValue) error
+	Close() error
+}
+
+// KVReader deserializes KeyValue records from an underlying stream. Decode
+// returns a non-nil error, typically io.EOF, once the stream is exhausted.
+type KVReader interface {
+	Decode(kv *KeyValue) error
+}
+
+// IntermediateCodec controls how map output is serialized for the shuffle
+// and read back on the reduce side. A job selects one codec for both sides
+// via Master.SetIntermediateCodec; the master tells each worker which one
+// to use for a given task through DoMapArgs/DoReduceArgs.Codec.
+type IntermediateCodec interface {
+	// Name identifies the codec across the wire; it must be a key in
+	// codecRegistry.
+	Name() string
+	NewWriter(w io.Writer) KVWriter
+	NewReader(r io.Reader) KVReader
+}
+
+// codecRegistry only has json and gob: a Snappy-compressed variant was
+// tried, but this tree has no vendor directory or module manifest to pull
+// github.com/golang/snappy through, so it can't build here. gob already
+// gets most of the win Snappy would have added on top - no per-record
+// field names or punctuation the way JSON has - and needs no external
+// dependency.
+var codecRegistry = map[string]IntermediateCodec{
+	"json": jsonCodec{},
+	"gob":  gobCodec{},
+}
+
+// codecByName resolves a codec tag to an IntermediateCodec, defaulting to
+// JSON (the original format) for an empty or unrecognized tag.
+func codecByName(name string) IntermediateCodec {
+	if c, ok := codecRegistry[name]; ok {
+		return c
+	}
+	return jsonCodec{}
+}
+
+// jsonCodec is the original line-delimited JSON format.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                   { return "json" }
+func (jsonCodec) NewWriter(w io.Writer) KVWriter { return &jsonKVWriter{enc: json.NewEncoder(w)} }
+func (jsonCodec) NewReader(r io.Reader) KVReader { return &jsonKVReader{dec: json.NewDecoder(r)} }
+
+type jsonKVWriter struct{ enc *json.Encoder }
+
+func (w *jsonKVWriter) Write(kv KeyValue) error { return w.enc.Encode(kv) }
+func (w *jsonKVWriter) Close() error            { return nil }
+
+type jsonKVReader struct{ dec *json.Decoder }
+
+func (r *jsonKVReader) Decode(kv *KeyValue) error { return r.dec.Decode(kv) }
+
+// gobKVWriter and gobKVReader share one gob.Encoder/Decoder across every
+// record in the stream, the way json.Encoder/json.Decoder already do
+// above. gob only sends a type descriptor once per concrete type on a
+// stream, so reusing the encoder/decoder rather than building a fresh one
+// per record is what actually gives gob its size advantage over JSON; an
+// earlier version of this codec built a new gob.Encoder for every single
+// record (plus a manual 4-byte length prefix to frame the result), which
+// paid that type descriptor on every record and ended up bigger and
+// slower than JSON - the opposite of the point. A shared encoder already
+// self-frames its stream, so no extra length prefix is needed.
+type gobKVWriter struct{ enc *gob.Encoder }
+
+func (w *gobKVWriter) Write(kv KeyValue) error { return w.enc.Encode(kv) }
+func (w *gobKVWriter) Close() error            { return nil }
+
+type gobKVReader struct{ dec *gob.Decoder }
+
+func (r *gobKVReader) Decode(kv *KeyValue) error { return r.dec.Decode(kv) }
+
+// gobCodec is a gob-encoded format: smaller and cheaper to encode/decode
+// than JSON, with no per-record field-name overhead.
+type gobCodec struct{}
+
+func (gobCodec) Name() string                   { return "gob" }
+func (gobCodec) NewWriter(w io.Writer) KVWriter { return &gobKVWriter{enc: gob.NewEncoder(w)} }
+func (gobCodec) NewReader(r io.Reader) KVReader { return &gobKVReader{dec: gob.NewDecoder(r)} }
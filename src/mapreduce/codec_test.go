@@ -0,0 +1,137 @@
+package mapreduce
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"testing"
+)
+
+// allCodecs is every codec registered in codecRegistry, used to drive the
+// round-trip tests and benchmark below against each one identically.
+var allCodecs = []IntermediateCodec{jsonCodec{}, gobCodec{}}
+
+func TestCodecRoundTrip(t *testing.T) {
+	kvs := []KeyValue{
+		{"apple", "1"},
+		{"banana", "2"},
+		{"", ""},
+		{"key with spaces", "value\nwith\nnewlines"},
+	}
+
+	for _, codec := range allCodecs {
+		t.Run(codec.Name(), func(t *testing.T) {
+			var buf bytes.Buffer
+			w := codec.NewWriter(&buf)
+			for _, kv := range kvs {
+				if err := w.Write(kv); err != nil {
+					t.Fatalf("Write(%v): %v", kv, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			r := codec.NewReader(&buf)
+			var got []KeyValue
+			for {
+				var kv KeyValue
+				err := r.Decode(&kv)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Decode: %v", err)
+				}
+				got = append(got, kv)
+			}
+
+			if len(got) != len(kvs) {
+				t.Fatalf("got %d records, want %d", len(got), len(kvs))
+			}
+			for i := range kvs {
+				if got[i] != kvs[i] {
+					t.Errorf("record %d = %v, want %v", i, got[i], kvs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	if _, ok := codecByName("gob").(gobCodec); !ok {
+		t.Errorf("codecByName(%q) did not return gobCodec", "gob")
+	}
+	if _, ok := codecByName("nonsense").(jsonCodec); !ok {
+		t.Errorf("codecByName(%q) should default to jsonCodec", "nonsense")
+	}
+}
+
+// BenchmarkShuffleIOOverIterations simulates the shuffle volume of a
+// PageRank-shaped job across its full 10-round run: PageRank emits one
+// record per outbound link plus one dampening-factor record per page every
+// round, so this writes pagesPerRound realistically-shaped records
+// (page-id keys, float-string PR values) rounds times per codec and
+// reports the average encoded size per round. Unlike BenchmarkCodecWrite,
+// which isolates a single Write call, this is about shuffle I/O volume
+// across the driver's actual iteration count, not per-call latency.
+func BenchmarkShuffleIOOverIterations(b *testing.B) {
+	const (
+		pagesPerRound = 2000
+		rounds        = 10
+	)
+	kvs := make([]KeyValue, pagesPerRound)
+	for i := range kvs {
+		kvs[i] = KeyValue{
+			Key:   fmt.Sprintf("page%d", i),
+			Value: strconv.FormatFloat(0.15+0.0001*float64(i), 'f', -1, 64),
+		}
+	}
+
+	for _, codec := range allCodecs {
+		b.Run(codec.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			var totalBytes int64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var buf bytes.Buffer
+				w := codec.NewWriter(&buf)
+				for round := 0; round < rounds; round++ {
+					for _, kv := range kvs {
+						if err := w.Write(kv); err != nil {
+							b.Fatalf("Write: %v", err)
+						}
+					}
+				}
+				if err := w.Close(); err != nil {
+					b.Fatalf("Close: %v", err)
+				}
+				totalBytes += int64(buf.Len())
+			}
+			b.ReportMetric(float64(totalBytes)/float64(b.N)/float64(rounds), "bytes/round")
+		})
+	}
+}
+
+// BenchmarkCodecWrite measures the per-record cost of encoding shuffle
+// output with each codec, the dominant cost the PageRank driver's
+// multi-iteration runs pay on every round.
+func BenchmarkCodecWrite(b *testing.B) {
+	kv := KeyValue{Key: "some-reasonably-long-intermediate-key", Value: "0.15000000000000002"}
+
+	for _, codec := range allCodecs {
+		b.Run(codec.Name(), func(b *testing.B) {
+			var buf bytes.Buffer
+			w := codec.NewWriter(&buf)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := w.Write(kv); err != nil {
+					b.Fatalf("Write: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package mapreduce
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+)
+
+// DataOutputDir is the directory under which intermediate and final job
+// output files are created.
+const DataOutputDir = "/var/tmp/824-mr/"
+
+// KeyValue is the type passed between the Map and Reduce phases.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// MapFunction is supplied by the user. It is invoked once per input file
+// with the file's name and contents, and returns the intermediate key/value
+// pairs produced from it.
+type MapFunction func(fileName, contents string) []KeyValue
+
+// ValueIter streams the values belonging to a single reduce key one at a
+// time, rather than requiring them all to be materialized in memory at
+// once. Next returns the next value and true, or ("", false) once
+// exhausted.
+type ValueIter interface {
+	Next() (string, bool)
+}
+
+// ReduceFunction is supplied by the user. It is invoked once per
+// intermediate key with an iterator over the values generated for that key
+// across all mappers, and returns the final value for that key.
+type ReduceFunction func(key string, values ValueIter) string
+
+// CombinerFunction is an optional, user-supplied function that runs on the
+// map side before a partition is written to disk. It is invoked once per
+// key within a single mapper's partition for one reducer, and its result
+// replaces that key's values, shrinking the amount of data shuffled to the
+// reducer. It has the same shape as a local reduce over that partition
+// alone.
+type CombinerFunction func(key string, values []string) string
+
+// reduceInputName returns the name of the intermediate file that mapper
+// mapperNum writes for reducer reducerNum to consume.
+func reduceInputName(jobName string, mapperNum, reducerNum uint) string {
+	return fmt.Sprintf("%smr.%s-%d-%d", DataOutputDir, jobName, mapperNum, reducerNum)
+}
+
+// ReduceOutputName returns the name of the file that reducer reducerNum
+// writes its final output to.
+func ReduceOutputName(jobName string, reducerNum uint) string {
+	return fmt.Sprintf("%smr.%s-res-%d", DataOutputDir, jobName, reducerNum)
+}
+
+// ihash picks the reducer a given intermediate key belongs to.
+func ihash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// checkErr panics with msg if err is non-nil.
+func checkErr(err error, msg string) {
+	if err != nil {
+		panic(fmt.Sprintf("%s: %v", msg, err))
+	}
+}
+
+// genWorkerAddress returns a unique unix-domain socket address for a new
+// worker to listen on.
+func genWorkerAddress() string {
+	return fmt.Sprintf("%sworker-%d-%d", DataOutputDir, os.Getpid(), rand.Int())
+}
+
+// genMasterAddress returns the well-known unix-domain socket address for a
+// job's master. It's derived from the job name so workers never need to be
+// told the master's address out of band.
+func genMasterAddress(jobName string) string {
+	return fmt.Sprintf("%smaster-%s", DataOutputDir, jobName)
+}
+
+// ParseCmdLine parses the standard "-reducers N file..." command line shared
+// by mapreduce drivers. The first return value is the job name, which
+// drivers may override themselves.
+func ParseCmdLine() (jobName string, numReducers uint, files []string) {
+	reducers := flag.Uint("reducers", 1, "number of reduce tasks")
+	flag.Parse()
+	return "", *reducers, flag.Args()
+}
@@ -0,0 +1,101 @@
+package mapreduce
+
+// NextInputFn computes the inputs for the next round of an IterativeJob,
+// given that job's shared context, the merged output path from the round
+// that just finished, and that round's 0-based iteration number.
+type NextInputFn func(ctx JobContext, prevOutputPath string, iteration int) []string
+
+// StopFn decides whether an IterativeJob should stop after the given round,
+// given that job's shared context and that round's merged output path.
+type StopFn func(ctx JobContext, iteration int, prevOutputPath string) bool
+
+// JobContext lets a driver thread long-lived state (e.g. a parsed graph)
+// through to NextInputFn and StopFn without resorting to package-level
+// globals.
+type JobContext map[string]interface{}
+
+// IterativeJob drives a mapreduce computation through repeated map/reduce
+// rounds over one long-lived master and worker pool, feeding each round's
+// output into the next via NextInputFn until StopFn says to stop. Unlike
+// driving a ParallelMaster by hand once per round, it never re-registers
+// workers or re-dials the RPC server between rounds.
+type IterativeJob struct {
+	jobName     string
+	numReducers uint
+	mapF        MapFunction
+	reduceF     ReduceFunction
+	combinerF   CombinerFunction
+	nextInputFn NextInputFn
+	stopFn      StopFn
+
+	initialInputs []string
+	numWorkers    int
+
+	// Context holds state a driver wants to share across rounds (e.g. the
+	// outbound-link graph for PageRank) and read back from inside
+	// NextInputFn or StopFn.
+	Context JobContext
+}
+
+// NewIterativeJob constructs an IterativeJob. It spins up one worker per
+// initial input file by default; use SetNumWorkers to change that.
+func NewIterativeJob(jobName string, initialInputs []string, reducers uint, mapF MapFunction, reduceF ReduceFunction, nextInputFn NextInputFn, stopFn StopFn) *IterativeJob {
+	return &IterativeJob{
+		jobName:       jobName,
+		numReducers:   reducers,
+		mapF:          mapF,
+		reduceF:       reduceF,
+		nextInputFn:   nextInputFn,
+		stopFn:        stopFn,
+		initialInputs: initialInputs,
+		numWorkers:    len(initialInputs),
+		Context:       make(JobContext),
+	}
+}
+
+// SetCombiner registers a map-side combiner to apply in every round's
+// workers.
+func (job *IterativeJob) SetCombiner(c CombinerFunction) {
+	job.combinerF = c
+}
+
+// SetNumWorkers overrides how many workers the job spins up, in case it
+// should differ from the number of initial input files.
+func (job *IterativeJob) SetNumWorkers(n int) {
+	job.numWorkers = n
+}
+
+// Run spins up the job's master and worker pool once, then repeatedly runs
+// map/reduce rounds - feeding each round's merged output into NextInputFn to
+// get the next round's inputs - until StopFn returns true. Intermediate
+// files are cleaned up between rounds. It returns the path to the final
+// round's merged output.
+func (job *IterativeJob) Run() string {
+	master := NewParallelMaster(job.jobName, job.initialInputs, job.numReducers, job.mapF, job.reduceF)
+	master.startRPCServer()
+	go master.watchHeartbeats()
+
+	for i := 0; i < job.numWorkers; i++ {
+		w := NewWorker(job.jobName, job.mapF, job.reduceF)
+		if job.combinerF != nil {
+			w.SetCombiner(job.combinerF)
+		}
+		go w.Start()
+	}
+
+	inputs := job.initialInputs
+	var outputPath string
+	for iteration := 0; ; iteration++ {
+		master.RunMapReduce(inputs)
+		outputPath = master.Merge()
+		master.CleanIntermediates()
+
+		if job.stopFn(job.Context, iteration, outputPath) {
+			break
+		}
+		inputs = job.nextInputFn(job.Context, outputPath, iteration)
+	}
+
+	master.Shutdown()
+	return outputPath
+}
@@ -0,0 +1,879 @@
+package mapreduce
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TaskState is the lifecycle of a single map or reduce task as tracked by
+// the master.
+type TaskState int
+
+const (
+	Idle TaskState = iota
+	InProgress
+	Completed
+)
+
+// defaultWorkerTimeout is how long the master waits without hearing a
+// heartbeat from the worker holding a task before it assumes that worker is
+// dead and reassigns the task.
+const defaultWorkerTimeout = 10 * time.Second
+
+// defaultBackupThreshold is the fraction of a phase's tasks that may still
+// be outstanding before the master starts speculatively re-executing
+// straggling in-progress tasks on another worker.
+const defaultBackupThreshold = 0.1
+
+// dispatchRetryBackoff is how long runPhase waits before re-dispatching a
+// task whose RPC just failed outright (e.g. connection refused because its
+// worker crashed). Without it, waitForIdleWorker keeps handing back the
+// same dead worker until the heartbeat monitor reaps it up to workerTimeout
+// later, and every failed attempt would otherwise spin a fresh dispatch
+// goroutine with no delay between them.
+const dispatchRetryBackoff = 100 * time.Millisecond
+
+// DispatchMode selects how a ParallelMaster hands tasks to workers.
+type DispatchMode int
+
+const (
+	// PushMode is the original protocol: the master calls DoMap/DoReduce
+	// directly on each registered worker, so the worker count must match
+	// the number of mappers/reducers.
+	PushMode DispatchMode = iota
+	// PullMode has workers call GetTask in a loop to ask for work, which
+	// decouples the worker count from the number of map/reduce tasks: a
+	// pool of N workers can work through M>>N tasks, and workers may join
+	// mid-job.
+	PullMode
+)
+
+// taskStatus is the master's bookkeeping for a single map or reduce task.
+type taskStatus struct {
+	state        TaskState
+	worker       string // address of the worker currently (or last) holding the task
+	lastPingTime time.Time
+}
+
+// ParallelMaster coordinates a single mapreduce job: it hands out map and
+// reduce tasks to registered workers and tracks their progress to
+// completion.
+type ParallelMaster struct {
+	jobName     string
+	address     string
+	mapFiles    []string
+	numReducers uint
+	mapF        MapFunction
+	reduceF     ReduceFunction
+	codec       IntermediateCodec
+
+	dispatchMode DispatchMode
+
+	mu              sync.Mutex
+	cond            *sync.Cond
+	workers         []string // addresses of registered workers, in arrival order
+	nextWorker      int      // round-robin cursor into workers, for waitForIdleWorker
+	mapTasks        []taskStatus
+	reduceTasks     []taskStatus
+	round           int // bumped by RunMapReduce each round, to detect late GetTask reports
+	workerTimeout   time.Duration
+	backupThreshold float64
+
+	// mapOwners[i] is the worker that last completed map task i. If that
+	// worker is later found to be dead, task i must be re-executed because
+	// its output lived on the dead worker's local disk.
+	mapOwners []string
+
+	listener net.Listener
+	stopCh   chan struct{}
+}
+
+// NewParallelMaster constructs a master for a job over the given input
+// files, splitting the reduce phase into numReducers tasks.
+func NewParallelMaster(jobName string, files []string, numReducers uint, mapF MapFunction, reduceF ReduceFunction) *ParallelMaster {
+	m := &ParallelMaster{
+		jobName:         jobName,
+		address:         genMasterAddress(jobName),
+		mapFiles:        files,
+		numReducers:     numReducers,
+		mapF:            mapF,
+		reduceF:         reduceF,
+		mapTasks:        make([]taskStatus, len(files)),
+		reduceTasks:     make([]taskStatus, numReducers),
+		mapOwners:       make([]string, len(files)),
+		workerTimeout:   defaultWorkerTimeout,
+		backupThreshold: defaultBackupThreshold,
+		codec:           jsonCodec{},
+		stopCh:          make(chan struct{}),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// SetWorkerTimeout overrides how long the master will wait for a heartbeat
+// from the worker holding a task before reassigning it. It must be called
+// before Start.
+func (m *ParallelMaster) SetWorkerTimeout(d time.Duration) {
+	m.workerTimeout = d
+}
+
+// SetBackupThreshold overrides how soon into a phase the master starts
+// speculatively re-executing still-in-progress tasks: once the fraction of
+// outstanding (not-yet-completed) tasks drops to or below fraction, every
+// task still in progress gets a backup copy dispatched to another worker,
+// and whichever copy finishes first wins. It must be called before Start
+// (or before the first RunMapReduce, for an IterativeJob). Only honored in
+// PushMode.
+func (m *ParallelMaster) SetBackupThreshold(fraction float64) {
+	m.backupThreshold = fraction
+}
+
+// SetDispatchMode selects how this master hands out tasks: PushMode (the
+// default) calls DoMap/DoReduce directly on registered workers, while
+// PullMode expects workers to call GetTask in a loop instead. It must be
+// called before Start (or before the first RunMapReduce, for an
+// IterativeJob), and workers must be started with the matching entry point
+// (Start for PushMode, StartPull for PullMode).
+func (m *ParallelMaster) SetDispatchMode(mode DispatchMode) {
+	m.dispatchMode = mode
+}
+
+// SetIntermediateCodec overrides how map output is serialized for the
+// shuffle and read back on the reduce side. It defaults to JSON. It must be
+// called before Start (or before the first RunMapReduce, for an
+// IterativeJob).
+func (m *ParallelMaster) SetIntermediateCodec(codec IntermediateCodec) {
+	m.codec = codec
+}
+
+// Start runs the RPC server, schedules the job's map and reduce phases to
+// completion, shuts down the workers, and returns. For a job that needs to
+// run several map/reduce rounds over a long-lived worker pool, use
+// IterativeJob instead.
+func (m *ParallelMaster) Start() {
+	m.startRPCServer()
+	go m.watchHeartbeats()
+	m.RunMapReduce(m.mapFiles)
+	m.Shutdown()
+}
+
+// RunMapReduce drives one round of map and reduce tasks over files to
+// completion against whatever workers are currently registered, resetting
+// this master's task bookkeeping for the new round first. It assumes the
+// RPC server and heartbeat monitor are already running (Start does this for
+// a single round; IterativeJob does it once up front and calls
+// RunMapReduce once per round).
+func (m *ParallelMaster) RunMapReduce(files []string) {
+	m.mu.Lock()
+	m.mapFiles = files
+	m.mapTasks = make([]taskStatus, len(files))
+	m.reduceTasks = make([]taskStatus, m.numReducers)
+	m.mapOwners = make([]string, len(files))
+	m.round++
+	mode := m.dispatchMode
+	m.mu.Unlock()
+
+	if mode == PullMode {
+		// Workers drive task assignment themselves via GetTask; just wait
+		// for both phases to drain.
+		m.waitAllCompleted(m.mapTasks)
+		m.waitAllCompleted(m.reduceTasks)
+		return
+	}
+
+	m.runPhase(m.mapTasks,
+		func(workerAddr string, idx int) (bool, interface{}) {
+			args := &DoMapArgs{
+				InputFileName: files[idx],
+				MapperNum:     uint(idx),
+				NumReducers:   m.numReducers,
+				Codec:         m.codec.Name(),
+			}
+			var reply DoMapReply
+			ok := call(workerAddr, "RPCWorker.DoMap", args, &reply)
+			return ok, reply.TempFiles
+		},
+		func(idx int, workerAddr string, result interface{}) {
+			m.commitMap(idx, result.([]string))
+			m.mu.Lock()
+			m.mapOwners[idx] = workerAddr
+			m.mu.Unlock()
+		},
+		func(result interface{}) { m.discardMap(result.([]string)) },
+	)
+
+	m.runPhase(m.reduceTasks,
+		func(workerAddr string, idx int) (bool, interface{}) {
+			args := &DoReduceArgs{ReducerNum: uint(idx), NumMappers: uint(len(files)), Codec: m.codec.Name()}
+			var reply DoReduceReply
+			ok := call(workerAddr, "RPCWorker.DoReduce", args, &reply)
+			return ok, reply.TempFile
+		},
+		func(idx int, workerAddr string, result interface{}) {
+			m.commitReduce(idx, result.(string))
+		},
+		func(result interface{}) { m.discardReduce(result.(string)) },
+	)
+}
+
+// CleanIntermediates removes the per-mapper/per-reducer intermediate files
+// written by the round of tasks that just completed, so the next round of
+// an IterativeJob starts from a clean slate instead of accumulating files
+// across iterations.
+func (m *ParallelMaster) CleanIntermediates() {
+	m.mu.Lock()
+	numMappers := len(m.mapTasks)
+	numReducers := len(m.reduceTasks)
+	m.mu.Unlock()
+
+	for r := 0; r < numReducers; r++ {
+		for mp := 0; mp < numMappers; mp++ {
+			os.Remove(reduceInputName(m.jobName, uint(mp), uint(r)))
+		}
+		os.Remove(ReduceOutputName(m.jobName, uint(r)))
+	}
+}
+
+// Shutdown stops the heartbeat monitor, tells every registered worker to
+// exit, and closes the RPC listener. Call it once the job (all rounds, for
+// an IterativeJob) is done.
+func (m *ParallelMaster) Shutdown() {
+	close(m.stopCh)
+	m.shutdownWorkers()
+	m.listener.Close()
+}
+
+// startRPCServer registers the master's RPC methods and begins serving
+// them on m.address in the background.
+func (m *ParallelMaster) startRPCServer() {
+	rpcs := rpc.NewServer()
+	rpcs.Register(m)
+
+	os.MkdirAll(DataOutputDir, 0777)
+	os.Remove(m.address)
+	l, err := net.Listen("unix", m.address)
+	checkErr(err, "[Master] Cannot start RPC server")
+	m.listener = l
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go rpcs.ServeConn(conn)
+		}
+	}()
+}
+
+// runPhase drives every task in tasks to completion, dispatching each one
+// to a registered worker via dispatch and re-dispatching it to a different
+// worker whenever its holder is declared dead.
+//
+// dispatch performs the RPC and returns whether it succeeded along with an
+// opaque result (e.g. the temp files it wrote). onCommit is called exactly
+// once per task, the first time dispatch succeeds for it, and is
+// responsible for making that task's output durable (e.g. renaming its temp
+// files into place). onDuplicate is called for every later successful
+// completion of a task that has already been committed — e.g. a straggler
+// that was reassigned away but finished anyway — and should discard that
+// completion's output.
+func (m *ParallelMaster) runPhase(tasks []taskStatus,
+	dispatch func(workerAddr string, idx int) (bool, interface{}),
+	onCommit func(idx int, workerAddr string, result interface{}),
+	onDuplicate func(result interface{})) {
+
+	var wg sync.WaitGroup
+
+	backedUp := make([]int32, len(tasks))
+	stopBackups := make(chan struct{})
+	go m.watchForStragglers(tasks, backedUp, &wg, dispatch, onCommit, onDuplicate, stopBackups)
+	defer close(stopBackups)
+
+	for i := range tasks {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			for {
+				worker := m.waitForIdleWorker()
+
+				m.mu.Lock()
+				tasks[idx].state = InProgress
+				tasks[idx].worker = worker
+				tasks[idx].lastPingTime = time.Now()
+				m.mu.Unlock()
+
+				type outcome struct {
+					ok     bool
+					result interface{}
+				}
+				doneCh := make(chan outcome, 1)
+				go func() {
+					ok, result := dispatch(worker, idx)
+					doneCh <- outcome{ok, result}
+				}()
+
+				select {
+				case o := <-doneCh:
+					if !o.ok {
+						// The RPC itself failed (e.g. connection refused);
+						// back off before trying another worker so a crashed
+						// worker that waitForIdleWorker keeps handing back
+						// (until the heartbeat monitor reaps it) doesn't spin
+						// this loop into a goroutine-creating busy loop.
+						m.markIdle(tasks, idx)
+						time.Sleep(dispatchRetryBackoff)
+						continue
+					}
+
+					m.mu.Lock()
+					alreadyCommitted := tasks[idx].state == Completed
+					if !alreadyCommitted {
+						tasks[idx].state = Completed
+					}
+					m.mu.Unlock()
+
+					if alreadyCommitted {
+						onDuplicate(o.result)
+						return
+					}
+					onCommit(idx, worker, o.result)
+					return
+				case <-m.taskTimedOut(tasks, idx):
+					// This fires either because the heartbeat monitor gave up
+					// on this worker, or because a backup copy of this task
+					// committed first. Abandon the in-flight call and let the
+					// doneCh branch above discard its result as a duplicate
+					// whenever it does return.
+					go func() {
+						o := <-doneCh
+						if o.ok {
+							onDuplicate(o.result)
+						}
+					}()
+
+					m.mu.Lock()
+					done := tasks[idx].state == Completed
+					m.mu.Unlock()
+					if done {
+						return
+					}
+					// The holder is presumed dead; loop back and reassign.
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// watchForStragglers periodically checks whether a phase has drained below
+// its backup threshold and, if so, proactively re-dispatches any task still
+// InProgress to another worker, so a single straggler can't hold up the
+// whole phase. Each task is backed up at most once. Whichever copy, primary
+// or backup, completes first wins via the same onCommit/onDuplicate
+// arbitration runPhase's own loop uses.
+func (m *ParallelMaster) watchForStragglers(tasks []taskStatus, backedUp []int32, wg *sync.WaitGroup,
+	dispatch func(workerAddr string, idx int) (bool, interface{}),
+	onCommit func(idx int, workerAddr string, result interface{}),
+	onDuplicate func(result interface{}),
+	stop <-chan struct{}) {
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if len(tasks) == 0 {
+				continue
+			}
+
+			m.mu.Lock()
+			outstanding := 0
+			for i := range tasks {
+				if tasks[i].state != Completed {
+					outstanding++
+				}
+			}
+			m.mu.Unlock()
+			if outstanding == 0 {
+				continue
+			}
+			// However small a phase is, the last task or two left standing
+			// are by definition the stragglers worth backing up; the
+			// threshold only matters for deciding when to start doing that
+			// in a larger phase.
+			belowThreshold := outstanding <= 1 || float64(outstanding)/float64(len(tasks)) <= m.backupThreshold
+			if !belowThreshold {
+				continue
+			}
+
+			for idx := range tasks {
+				m.mu.Lock()
+				inProgress := tasks[idx].state == InProgress
+				owner := tasks[idx].worker
+				m.mu.Unlock()
+				if !inProgress || !atomic.CompareAndSwapInt32(&backedUp[idx], 0, 1) {
+					continue
+				}
+				wg.Add(1)
+				go m.runBackupCopy(tasks, idx, owner, &backedUp[idx], dispatch, onCommit, onDuplicate, wg)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// runBackupCopy dispatches a single speculative copy of tasks[idx] to a
+// worker other than its current owner (falling back to the owner if no
+// other worker is registered). If it completes and wins the race against
+// the primary copy, it commits the task itself; otherwise its output is
+// discarded. It counts against runPhase's WaitGroup so the phase can't end
+// while a backup copy is still in flight and later commit into the next
+// round's bookkeeping.
+func (m *ParallelMaster) runBackupCopy(tasks []taskStatus, idx int, owner string, backedUp *int32,
+	dispatch func(workerAddr string, idx int) (bool, interface{}),
+	onCommit func(idx int, workerAddr string, result interface{}),
+	onDuplicate func(result interface{}),
+	wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	worker := m.waitForIdleWorkerExcept(owner)
+	ok, result := dispatch(worker, idx)
+	if !ok {
+		// The backup attempt itself failed; allow a later tick to retry.
+		atomic.StoreInt32(backedUp, 0)
+		return
+	}
+
+	m.mu.Lock()
+	alreadyCommitted := tasks[idx].state == Completed
+	if !alreadyCommitted {
+		tasks[idx].state = Completed
+	}
+	m.mu.Unlock()
+
+	if alreadyCommitted {
+		onDuplicate(result)
+		return
+	}
+	onCommit(idx, worker, result)
+}
+
+// taskTimedOut returns a channel that is closed once the heartbeat monitor
+// has marked tasks[idx] Idle again, signalling that its current holder
+// should be considered dead.
+func (m *ParallelMaster) taskTimedOut(tasks []taskStatus, idx int) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		for {
+			m.mu.Lock()
+			state := tasks[idx].state
+			m.mu.Unlock()
+			if state != InProgress {
+				return
+			}
+			select {
+			case <-time.After(200 * time.Millisecond):
+			case <-m.stopCh:
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// markIdle resets a task so it can be picked up by another worker.
+func (m *ParallelMaster) markIdle(tasks []taskStatus, idx int) {
+	m.mu.Lock()
+	tasks[idx].state = Idle
+	m.mu.Unlock()
+	m.cond.Broadcast()
+}
+
+// commitMap makes a completed map task's output durable by renaming its
+// temp files into place under their well-known reduceInputName paths.
+func (m *ParallelMaster) commitMap(idx int, tempFiles []string) {
+	for reducerNum, tempFile := range tempFiles {
+		finalName := reduceInputName(m.jobName, uint(idx), uint(reducerNum))
+		checkErr(os.Rename(tempFile, finalName), "[Master] Cannot commit map output")
+	}
+}
+
+// discardMap removes the temp output of a map task completion that lost the
+// race to another copy of the same task.
+func (m *ParallelMaster) discardMap(tempFiles []string) {
+	for _, f := range tempFiles {
+		os.Remove(f)
+	}
+}
+
+// commitReduce makes a completed reduce task's output durable by renaming
+// its temp file into place under its well-known ReduceOutputName path.
+func (m *ParallelMaster) commitReduce(idx int, tempFile string) {
+	finalName := ReduceOutputName(m.jobName, uint(idx))
+	checkErr(os.Rename(tempFile, finalName), "[Master] Cannot commit reduce output")
+}
+
+// discardReduce removes the temp output of a reduce task completion that
+// lost the race to another copy of the same task.
+func (m *ParallelMaster) discardReduce(tempFile string) {
+	os.Remove(tempFile)
+}
+
+// waitAllCompleted blocks until every task in tasks has reached the
+// Completed state. It's how RunMapReduce waits out a phase in PullMode,
+// where there's no per-task goroutine of its own to wait on.
+func (m *ParallelMaster) waitAllCompleted(tasks []taskStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for !allCompletedLocked(tasks) {
+		m.cond.Wait()
+	}
+}
+
+func allCompletedLocked(tasks []taskStatus) bool {
+	for i := range tasks {
+		if tasks[i].state != Completed {
+			return false
+		}
+	}
+	return true
+}
+
+// firstIdleLocked returns the index of the first Idle task in tasks, for
+// GetTask to hand out. Callers must hold m.mu.
+func firstIdleLocked(tasks []taskStatus) (int, bool) {
+	for i := range tasks {
+		if tasks[i].state == Idle {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// markCompleted transitions tasks[idx] to Completed if it isn't already,
+// and reports whether it was already Completed (i.e. this is a straggler
+// completion that lost the race and should be discarded rather than
+// committed).
+func (m *ParallelMaster) markCompleted(tasks []taskStatus, idx int) (alreadyCompleted bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if idx < 0 || idx >= len(tasks) {
+		return true
+	}
+	alreadyCompleted = tasks[idx].state == Completed
+	if !alreadyCompleted {
+		tasks[idx].state = Completed
+	}
+	return alreadyCompleted
+}
+
+// waitForIdleWorker blocks until at least one worker is registered, then
+// returns the next one in round-robin order so concurrent tasks in a phase
+// spread across every registered worker rather than piling onto the first
+// one. Workers may still be handed more than one task concurrently once
+// every worker has one; that's fine since each dispatch runs in its own
+// goroutine.
+func (m *ParallelMaster) waitForIdleWorker() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.workers) == 0 {
+		m.cond.Wait()
+	}
+	w := m.workers[m.nextWorker%len(m.workers)]
+	m.nextWorker++
+	return w
+}
+
+// waitForIdleWorkerExcept is like waitForIdleWorker but prefers any
+// registered worker other than exclude, falling back to exclude itself if
+// it's the only one registered. It's used to send a straggler task's
+// backup copy to a different worker than the one already holding it.
+func (m *ParallelMaster) waitForIdleWorkerExcept(exclude string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		for _, w := range m.workers {
+			if w != exclude {
+				return w
+			}
+		}
+		if len(m.workers) > 0 {
+			return m.workers[0]
+		}
+		m.cond.Wait()
+	}
+}
+
+// watchHeartbeats periodically scans for in-progress tasks whose worker has
+// gone silent for longer than workerTimeout, and reclaims them. If the
+// reclaimed task is a map task, any reduce task that was previously
+// completed by the same dead worker is untouched (reduce output lives on a
+// shared path), but map tasks the dead worker had completed are
+// re-executed, since their output lived on the dead worker's local disk.
+func (m *ParallelMaster) watchHeartbeats() {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.reapDeadWorkers()
+		case <-m.stopCh:
+			return
+		}
+	}
+}
+
+func (m *ParallelMaster) reapDeadWorkers() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deadline := time.Now().Add(-m.workerTimeout)
+	dead := make(map[string]bool)
+
+	reapPhase := func(tasks []taskStatus) {
+		for i := range tasks {
+			if tasks[i].state == InProgress && tasks[i].lastPingTime.Before(deadline) {
+				dead[tasks[i].worker] = true
+				tasks[i].state = Idle
+			}
+		}
+	}
+	reapPhase(m.mapTasks)
+	reapPhase(m.reduceTasks)
+
+	if len(dead) == 0 {
+		return
+	}
+
+	// A dead worker's completed map output is lost along with it, so any
+	// map task it had finished must also be re-executed.
+	for i, owner := range m.mapOwners {
+		if owner != "" && dead[owner] && m.mapTasks[i].state == Completed {
+			m.mapTasks[i].state = Idle
+			m.mapOwners[i] = ""
+		}
+	}
+
+	m.workers = removeAll(m.workers, dead)
+	m.cond.Broadcast()
+}
+
+func removeAll(addrs []string, remove map[string]bool) []string {
+	kept := addrs[:0]
+	for _, a := range addrs {
+		if !remove[a] {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+// shutdownWorkers tells every still-registered worker to exit.
+func (m *ParallelMaster) shutdownWorkers() {
+	m.mu.Lock()
+	workers := append([]string(nil), m.workers...)
+	m.mu.Unlock()
+
+	for _, w := range workers {
+		call(w, "RPCWorker.Shutdown", new(interface{}), new(interface{}))
+	}
+}
+
+// Merge reads every reducer's output, merges it into a single
+// lexicographically-sorted file, and returns that file's path. It decodes
+// reducer output with the same codec the reduce phase wrote it with.
+func (m *ParallelMaster) Merge() string {
+	kvs := make(map[string]string)
+	for i := uint(0); i < m.numReducers; i++ {
+		fileName := ReduceOutputName(m.jobName, i)
+		file, err := os.Open(fileName)
+		checkErr(err, "[Master] Cannot open reducer output file")
+
+		kr := m.codec.NewReader(file)
+		var kv KeyValue
+		for kr.Decode(&kv) == nil {
+			kvs[kv.Key] = kv.Value
+		}
+		file.Close()
+	}
+
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	outName := fmt.Sprintf("%smr.%s-merged", DataOutputDir, m.jobName)
+	out, err := os.Create(outName)
+	checkErr(err, "[Master] Cannot create merged output file")
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s: %s\n", k, kvs[k])
+	}
+	w.Flush()
+
+	return outName
+}
+
+//
+// RPC methods begin after this.
+//
+
+// Register is called by a worker on startup to announce its address.
+func (m *ParallelMaster) Register(args *RegisterArgs, reply *interface{}) error {
+	m.mu.Lock()
+	m.workers = append(m.workers, args.WorkerAddress)
+	m.mu.Unlock()
+	m.cond.Broadcast()
+	return nil
+}
+
+// HeartbeatArgs are sent periodically by a worker to prove it's still
+// alive and report its progress.
+type HeartbeatArgs struct {
+	WorkerAddress string
+	MapsDone      uint
+	ReducesDone   uint
+}
+
+// Heartbeat is called periodically by every worker holding a task. It
+// refreshes the lastPingTime the master uses to detect dead workers.
+func (m *ParallelMaster) Heartbeat(args *HeartbeatArgs, reply *interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for i := range m.mapTasks {
+		if m.mapTasks[i].state == InProgress && m.mapTasks[i].worker == args.WorkerAddress {
+			m.mapTasks[i].lastPingTime = now
+		}
+	}
+	for i := range m.reduceTasks {
+		if m.reduceTasks[i].state == InProgress && m.reduceTasks[i].worker == args.WorkerAddress {
+			m.reduceTasks[i].lastPingTime = now
+		}
+	}
+	return nil
+}
+
+// GetTaskArgs is sent by a worker calling GetTask in PullMode. It doubles
+// as the worker's report of the task it was last handed: LastTaskType is
+// "" on a worker's very first call, and "map" or "reduce" afterward, with
+// LastTaskID and the matching LastMapFiles/LastReduceFile describing that
+// task's result for the master to commit or discard.
+type GetTaskArgs struct {
+	WorkerID     string
+	LastTaskType string
+	LastTaskID   int
+
+	LastMapFiles   []string // set when LastTaskType == "map"
+	LastReduceFile string   // set when LastTaskType == "reduce"
+}
+
+// GetTaskReply is the master's response to GetTask. TaskType is "map",
+// "reduce", "wait" (the map phase hasn't fully drained yet), or "done" (the
+// round is over and the worker should exit). MapArgs/ReduceArgs is set when
+// TaskType is the matching value.
+type GetTaskReply struct {
+	TaskType   string
+	MapArgs    *DoMapArgs
+	ReduceArgs *DoReduceArgs
+}
+
+// GetTask is the PullMode counterpart to the push RPCs: instead of the
+// master calling DoMap/DoReduce on registered workers, a worker calls
+// GetTask in a loop, reporting the task it just finished (if any) and
+// receiving its next assignment. This decouples the worker count from the
+// number of map/reduce tasks.
+func (m *ParallelMaster) GetTask(args *GetTaskArgs, reply *GetTaskReply) error {
+	// Snapshot the task slices (and the round they belong to) before
+	// touching them: RunMapReduce reassigns m.mapTasks/m.reduceTasks/
+	// m.mapOwners under m.mu at the start of every round, and reading those
+	// fields directly here (as markCompleted's argument, or as the target of
+	// the mapOwners write below) would race with that reassignment. If the
+	// round has already moved on by the time we get here, the snapshotted
+	// task will already be Completed, so markCompleted correctly treats this
+	// as a late duplicate report and discards its output; the round check
+	// before writing mapOwners catches the same staleness for a task index
+	// that markCompleted can't flag because the new round's task at that
+	// index is still Idle.
+	m.mu.Lock()
+	round := m.round
+	mapTasks, reduceTasks := m.mapTasks, m.reduceTasks
+	m.mu.Unlock()
+
+	switch args.LastTaskType {
+	case "map":
+		if m.markCompleted(mapTasks, args.LastTaskID) {
+			m.discardMap(args.LastMapFiles)
+		} else {
+			m.commitMap(args.LastTaskID, args.LastMapFiles)
+			m.mu.Lock()
+			if m.round == round {
+				m.mapOwners[args.LastTaskID] = args.WorkerID
+			}
+			m.mu.Unlock()
+			m.cond.Broadcast()
+		}
+	case "reduce":
+		if m.markCompleted(reduceTasks, args.LastTaskID) {
+			m.discardReduce(args.LastReduceFile)
+		} else {
+			m.commitReduce(args.LastTaskID, args.LastReduceFile)
+			m.cond.Broadcast()
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if idx, ok := firstIdleLocked(m.mapTasks); ok {
+		m.mapTasks[idx].state = InProgress
+		m.mapTasks[idx].worker = args.WorkerID
+		m.mapTasks[idx].lastPingTime = time.Now()
+		reply.TaskType = "map"
+		reply.MapArgs = &DoMapArgs{
+			InputFileName: m.mapFiles[idx],
+			MapperNum:     uint(idx),
+			NumReducers:   m.numReducers,
+			Codec:         m.codec.Name(),
+		}
+		return nil
+	}
+	if !allCompletedLocked(m.mapTasks) {
+		reply.TaskType = "wait"
+		return nil
+	}
+
+	if idx, ok := firstIdleLocked(m.reduceTasks); ok {
+		m.reduceTasks[idx].state = InProgress
+		m.reduceTasks[idx].worker = args.WorkerID
+		m.reduceTasks[idx].lastPingTime = time.Now()
+		reply.TaskType = "reduce"
+		reply.ReduceArgs = &DoReduceArgs{
+			ReducerNum: uint(idx),
+			NumMappers: uint(len(m.mapFiles)),
+			Codec:      m.codec.Name(),
+		}
+		return nil
+	}
+	if !allCompletedLocked(m.reduceTasks) {
+		reply.TaskType = "wait"
+		return nil
+	}
+
+	reply.TaskType = "done"
+	return nil
+}
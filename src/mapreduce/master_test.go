@@ -0,0 +1,353 @@
+package mapreduce
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// wordCountMap and wordCountSumReduce are tiny map/reduce functions used
+// only to exercise the scheduler in these tests.
+func wordCountMap(fileName, contents string) []KeyValue {
+	return []KeyValue{{fileName, contents}}
+}
+
+func wordCountSumReduce(key string, values ValueIter) string {
+	n := 0
+	for _, ok := values.Next(); ok; _, ok = values.Next() {
+		n++
+	}
+	return strconv.Itoa(n)
+}
+
+func writeTestInput(t *testing.T, jobName string, n int) []string {
+	t.Helper()
+	os.MkdirAll(DataOutputDir, 0777)
+
+	files := make([]string, n)
+	for i := 0; i < n; i++ {
+		name := DataOutputDir + jobName + "-in-" + strconv.Itoa(i)
+		checkErr(ioutil.WriteFile(name, []byte("hello"), 0664), "write test input")
+		files[i] = name
+	}
+	return files
+}
+
+// TestMasterSurvivesDeadWorker kills one worker mid-job and verifies the
+// job still completes, with its tasks reassigned to the surviving worker.
+func TestMasterSurvivesDeadWorker(t *testing.T) {
+	jobName := "heartbeat-test"
+	files := writeTestInput(t, jobName, 2)
+
+	master := NewParallelMaster(jobName, files, 2, wordCountMap, wordCountSumReduce)
+	master.SetWorkerTimeout(300 * time.Millisecond)
+
+	done := make(chan bool)
+	go func() {
+		master.Start()
+		done <- true
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	doomed := NewWorker(jobName, wordCountMap, wordCountSumReduce)
+	go doomed.Start()
+	<-doomed.Ready()
+
+	survivor := NewWorker(jobName, wordCountMap, wordCountSumReduce)
+	go survivor.Start()
+	<-survivor.Ready()
+
+	// Give the doomed worker a moment to pick up a task, then kill it
+	// without telling the master, simulating a crash.
+	time.Sleep(100 * time.Millisecond)
+	doomed.rpcListener.Close()
+	os.Remove(doomed.address)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not complete after a worker died; tasks were not reassigned")
+	}
+
+	survivor.Shutdown()
+}
+
+// TestFailedDispatchBacksOff verifies that runPhase backs off between
+// retries of a task whose dispatch keeps failing (e.g. its worker crashed
+// and waitForIdleWorker keeps handing back that same dead worker until the
+// heartbeat monitor reaps it). Before dispatchRetryBackoff existed, this
+// retried with no delay and a fresh goroutine per attempt, so a dead worker
+// pegged the CPU and grew the goroutine count without bound for the whole
+// reap window.
+func TestFailedDispatchBacksOff(t *testing.T) {
+	master := NewParallelMaster("backoff-test", nil, 0, wordCountMap, wordCountSumReduce)
+	master.workers = []string{"dead-worker"}
+
+	var calls int32
+	alwaysFails := func(workerAddr string, idx int) (bool, interface{}) {
+		atomic.AddInt32(&calls, 1)
+		return false, nil
+	}
+
+	tasks := []taskStatus{{state: Idle}}
+	baseline := runtime.NumGoroutine()
+	go master.runPhase(tasks, alwaysFails, func(int, string, interface{}) {}, func(interface{}) {})
+
+	time.Sleep(500 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&calls); n > 20 {
+		t.Fatalf("dispatch retried %d times in 500ms with a %v backoff; retries are not throttled", n, dispatchRetryBackoff)
+	}
+	if grown := runtime.NumGoroutine() - baseline; grown > 50 {
+		t.Fatalf("goroutine count grew by %d while retrying a failing dispatch", grown)
+	}
+}
+
+// stragglerOnce makes exactly the first call to straggleOnceMap block for a
+// while, simulating one straggler map task without caring which worker ends
+// up drawing it.
+var stragglerOnce int32
+
+func straggleOnceMap(fileName, contents string) []KeyValue {
+	if atomic.CompareAndSwapInt32(&stragglerOnce, 0, 1) {
+		time.Sleep(2 * time.Second)
+	}
+	return []KeyValue{{fileName, contents}}
+}
+
+// TestBackupExecutionRescuesStraggler verifies that once a phase has mostly
+// drained, the master speculatively re-dispatches the one task still stuck
+// in progress rather than waiting out its straggling worker.
+func TestBackupExecutionRescuesStraggler(t *testing.T) {
+	atomic.StoreInt32(&stragglerOnce, 0)
+
+	jobName := "backup-test"
+	files := writeTestInput(t, jobName, 3)
+
+	master := NewParallelMaster(jobName, files, 1, straggleOnceMap, wordCountSumReduce)
+	master.SetBackupThreshold(0.5)
+
+	done := make(chan bool)
+	go func() {
+		master.Start()
+		done <- true
+	}()
+
+	w1 := NewWorker(jobName, straggleOnceMap, wordCountSumReduce)
+	go w1.Start()
+	<-w1.Ready()
+	defer w1.Shutdown()
+
+	w2 := NewWorker(jobName, straggleOnceMap, wordCountSumReduce)
+	go w2.Start()
+	<-w2.Ready()
+	defer w2.Shutdown()
+
+	select {
+	case <-done:
+	case <-time.After(1500 * time.Millisecond):
+		t.Fatal("job did not finish quickly; the straggler task was not backed up")
+	}
+}
+
+// TestGobCodecEndToEnd runs a real job with the gob codec selected instead
+// of the default JSON one, checking that DoMapArgs/DoReduceArgs.Codec
+// actually carries the choice to the worker over RPC and that Merge can
+// decode what the reduce phase wrote with it.
+func TestGobCodecEndToEnd(t *testing.T) {
+	jobName := "gob-codec-test"
+	files := writeTestInput(t, jobName, 2)
+
+	master := NewParallelMaster(jobName, files, 1, wordCountMap, wordCountSumReduce)
+	master.SetIntermediateCodec(gobCodec{})
+
+	done := make(chan bool)
+	go func() {
+		master.Start()
+		done <- true
+	}()
+
+	w := NewWorker(jobName, wordCountMap, wordCountSumReduce)
+	go w.Start()
+	<-w.Ready()
+	defer w.Shutdown()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job with the gob codec selected did not complete")
+	}
+
+	out, err := ioutil.ReadFile(master.Merge())
+	checkErr(err, "read merged output")
+	want := DataOutputDir + jobName + "-in-0: 1\n" + DataOutputDir + jobName + "-in-1: 1\n"
+	if got := string(out); got != want {
+		t.Errorf("merged output = %q, want %q", got, want)
+	}
+}
+
+// sumCombine is a CombinerFunction that sums its values as integers,
+// recording on combinerCalls whether it ever actually ran.
+var combinerCalls int32
+
+func sumCombine(key string, values []string) string {
+	atomic.AddInt32(&combinerCalls, 1)
+	sum := 0
+	for _, v := range values {
+		n, err := strconv.Atoi(v)
+		checkErr(err, "parse combiner input: "+v)
+		sum += n
+	}
+	return strconv.Itoa(sum)
+}
+
+// repeatedCountsMap emits the same key several times with value "1", giving
+// a combiner something to collapse within a single mapper's partition.
+func repeatedCountsMap(fileName, contents string) []KeyValue {
+	kvs := make([]KeyValue, 0, 4)
+	for i := 0; i < 4; i++ {
+		kvs = append(kvs, KeyValue{"count", "1"})
+	}
+	return kvs
+}
+
+// countSumReduce adds up the (already-combined) per-mapper partial sums for
+// "count" across all mappers.
+func countSumReduce(key string, values ValueIter) string {
+	sum := 0
+	for v, ok := values.Next(); ok; v, ok = values.Next() {
+		n, err := strconv.Atoi(v)
+		checkErr(err, "parse reduce input: "+v)
+		sum += n
+	}
+	return strconv.Itoa(sum)
+}
+
+// TestCombinerRunsOnMapOutput verifies the wired-up combiner path end to
+// end: a worker with a combiner registered via SetCombiner actually invokes
+// it while running DoMap, and the combined output still reduces to the
+// correct final answer.
+func TestCombinerRunsOnMapOutput(t *testing.T) {
+	atomic.StoreInt32(&combinerCalls, 0)
+
+	jobName := "combiner-test"
+	files := writeTestInput(t, jobName, 2)
+
+	master := NewParallelMaster(jobName, files, 1, repeatedCountsMap, countSumReduce)
+
+	done := make(chan bool)
+	go func() {
+		master.Start()
+		done <- true
+	}()
+
+	w := NewWorker(jobName, repeatedCountsMap, countSumReduce)
+	w.SetCombiner(sumCombine)
+	go w.Start()
+	<-w.Ready()
+	defer w.Shutdown()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job with a combiner registered did not complete")
+	}
+
+	if atomic.LoadInt32(&combinerCalls) == 0 {
+		t.Fatal("combiner was never invoked; it is not being applied to map output")
+	}
+
+	out, err := ioutil.ReadFile(master.Merge())
+	checkErr(err, "read merged output")
+	if got := string(out); got != "count: 8\n" {
+		t.Errorf("merged output = %q, want %q", got, "count: 8\n")
+	}
+}
+
+// TestPullModeWorkerCountDiffersFromTaskCount drives a job with more map
+// tasks than workers entirely through GetTask, verifying that a small pool
+// of workers can pull its way through a larger set of tasks rather than
+// needing one worker per task the way PushMode does.
+func TestPullModeWorkerCountDiffersFromTaskCount(t *testing.T) {
+	jobName := "pull-test"
+	files := writeTestInput(t, jobName, 5)
+
+	master := NewParallelMaster(jobName, files, 2, wordCountMap, wordCountSumReduce)
+	master.SetDispatchMode(PullMode)
+
+	done := make(chan bool)
+	go func() {
+		master.Start()
+		done <- true
+	}()
+
+	w1 := NewWorker(jobName, wordCountMap, wordCountSumReduce)
+	go w1.StartPull()
+	<-w1.Ready()
+	defer w1.Shutdown()
+
+	w2 := NewWorker(jobName, wordCountMap, wordCountSumReduce)
+	go w2.StartPull()
+	<-w2.Ready()
+	defer w2.Shutdown()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job with 2 workers pulling 5 map tasks did not complete")
+	}
+}
+
+// TestStartPullStopsOnShutdown verifies that Shutdown actually stops the
+// StartPull goroutine instead of leaving it polling GetTask forever. A
+// leaked poller from one job can reconnect to a later job reusing the same
+// jobName (genMasterAddress is deterministic) and report a stale task. The
+// job here has a single map task and two workers, so once w1 claims the
+// only map task, w2's GetTask calls land in the "wait" branch, letting us
+// Shutdown it mid-poll while the job is still running.
+func TestStartPullStopsOnShutdown(t *testing.T) {
+	jobName := "pull-shutdown-test"
+	files := writeTestInput(t, jobName, 1)
+
+	// slowMap keeps the job (and hence the master's RPC server) alive long
+	// enough for w2 to register and poll a few times before we shut it down,
+	// so Shutdown truly races a live GetTask loop rather than a worker that
+	// can no longer even register because the job already finished.
+	slowMap := func(fileName, contents string) []KeyValue {
+		time.Sleep(1 * time.Second)
+		return wordCountMap(fileName, contents)
+	}
+
+	master := NewParallelMaster(jobName, files, 1, slowMap, wordCountSumReduce)
+	master.SetDispatchMode(PullMode)
+	go master.Start()
+
+	w1 := NewWorker(jobName, slowMap, wordCountSumReduce)
+	go w1.StartPull()
+	<-w1.Ready()
+	defer w1.Shutdown()
+
+	// Give w1 a head start so it claims the job's only map task before w2
+	// starts polling, forcing w2 into the "wait" branch.
+	time.Sleep(100 * time.Millisecond)
+
+	w2 := NewWorker(jobName, slowMap, wordCountSumReduce)
+	returned := make(chan bool)
+	go func() {
+		w2.StartPull()
+		returned <- true
+	}()
+	<-w2.Ready()
+
+	w2.Shutdown()
+
+	select {
+	case <-returned:
+	case <-time.After(2 * time.Second):
+		t.Fatal("StartPull did not return after Shutdown")
+	}
+}
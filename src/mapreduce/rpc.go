@@ -0,0 +1,62 @@
+package mapreduce
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+)
+
+// RegisterArgs are the arguments a worker sends the master to announce
+// itself when it starts up.
+type RegisterArgs struct {
+	WorkerAddress string
+}
+
+// startWorkerRPCServer registers w's RPC methods and starts serving them on
+// w.address in the background.
+func startWorkerRPCServer(w *Worker) net.Listener {
+	rpcs := rpc.NewServer()
+	rpcs.Register((*RPCWorker)(w))
+
+	os.Remove(w.address)
+	l, err := net.Listen("unix", w.address)
+	checkErr(err, "[Worker] Cannot start RPC server")
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if w.IsActive() {
+					fmt.Printf("[Worker] RPC accept error: %v\n", err)
+				}
+				return
+			}
+			go func() {
+				rpcs.ServeConn(conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return l
+}
+
+// call dials the RPC server at address, invokes rpcname with args, and
+// stores the result in reply. It returns false if the call could not be
+// completed, e.g. because the remote end is down.
+func call(address, rpcname string, args interface{}, reply interface{}) bool {
+	c, err := rpc.Dial("unix", address)
+	if err != nil {
+		return false
+	}
+	defer c.Close()
+
+	return c.Call(rpcname, args, reply) == nil
+}
+
+// callMaster is a convenience wrapper around call for a worker talking to
+// its job's master.
+func (w *Worker) callMaster(rpcname string, args interface{}, reply interface{}) bool {
+	return call(w.masterAddress, rpcname, args, reply)
+}
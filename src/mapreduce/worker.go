@@ -1,60 +1,163 @@
 package mapreduce
 
 import (
-	"encoding/json"
+	"container/heap"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync/atomic"
 	"time"
 )
 
+// heartbeatInterval is how often a worker pings the master to prove it's
+// still alive. It should be comfortably shorter than the master's
+// configured worker timeout.
+const heartbeatInterval = 2 * time.Second
+
 // A worker executes a user's map and reduce functions.
 type Worker struct {
-	jobName     string         // The name of the job.
-	mapF        MapFunction    // The user's map function.
-	reduceF     ReduceFunction // The user's reduce function.
-	rpcListener net.Listener   // The RPC listener.
-	active      int32          // Whether this worker is accepting work.
-	done        chan bool      // Used to signal RPC server is done.
-	address     string         // This worker's address for RPC.
-	mapsDone    int32          // How many map ops this worker has completed.
-	reducesDone int32          // How many reduce ops this worker has completed.
+	jobName       string           // The name of the job.
+	mapF          MapFunction      // The user's map function.
+	reduceF       ReduceFunction   // The user's reduce function.
+	combinerF     CombinerFunction // Optional map-side combiner.
+	rpcListener   net.Listener     // The RPC listener.
+	active        int32            // Whether this worker is accepting work.
+	done          chan bool        // Used to signal RPC server is done.
+	ready         chan struct{}    // Closed once rpcListener is set and the worker has registered.
+	address       string           // This worker's address for RPC.
+	masterAddress string           // The address of this job's master.
+	mapsDone      int32            // How many map ops this worker has completed.
+	reducesDone   int32            // How many reduce ops this worker has completed.
 }
 
 // Constructs a new worker with the given inputs.
 func NewWorker(job string, mapF MapFunction, reduceF ReduceFunction) *Worker {
 	return &Worker{
-		jobName:     job,
-		mapF:        mapF,
-		reduceF:     reduceF,
-		active:      0,
-		done:        make(chan bool),
-		address:     genWorkerAddress(),
-		mapsDone:    0,
-		reducesDone: 0,
+		jobName:       job,
+		mapF:          mapF,
+		reduceF:       reduceF,
+		active:        0,
+		done:          make(chan bool),
+		ready:         make(chan struct{}),
+		address:       genWorkerAddress(),
+		masterAddress: genMasterAddress(job),
+		mapsDone:      0,
+		reducesDone:   0,
 	}
 }
 
-// Starts the worker by launching the RPC server and blocking until the worker
-// receives a Shutdown call.
-func (w *Worker) Start() {
+// SetCombiner registers a map-side combiner that runs on each partition
+// before it's written to disk, collapsing duplicate keys to shrink shuffle
+// size. It must be called before Start. Unlike the codec, the combiner is
+// a function value rather than one of a small fixed set, so it isn't
+// threaded through RPC the way DoMapArgs.Codec is - like mapF and reduceF,
+// it must be set directly on each Worker the caller constructs.
+// IterativeJob.SetCombiner does this for every worker it spins up.
+func (w *Worker) SetCombiner(c CombinerFunction) {
+	w.combinerF = c
+}
+
+// Ready returns a channel that's closed once the worker's RPC listener is
+// up and it has registered with the master, i.e. once rpcListener and
+// address are safe for another goroutine to read. Callers that need to act
+// on a just-started worker from outside its own goroutine (e.g. a test that
+// wants to kill it mid-job) should wait on this instead of sleeping.
+func (w *Worker) Ready() <-chan struct{} {
+	return w.ready
+}
+
+// setup starts the RPC server, registers with the master, closes ready, and
+// starts the heartbeat loop. Both Start and StartPull call it before
+// entering their respective dispatch loops.
+func (w *Worker) setup() {
 	atomic.StoreInt32(&w.active, 1)
 	w.rpcListener = startWorkerRPCServer(w)
 	w.RegisterWithServer()
+	close(w.ready)
+	go w.sendHeartbeats()
+}
+
+// Starts the worker by launching the RPC server and blocking until the worker
+// receives a Shutdown call.
+func (w *Worker) Start() {
+	w.setup()
 	<-w.done
 }
 
+// pullPollInterval is how long a worker in PullMode sleeps between GetTask
+// calls when the master reports "wait" (no task ready yet).
+const pullPollInterval = 500 * time.Millisecond
+
+// StartPull runs the worker against a master configured with
+// SetDispatchMode(PullMode): instead of waiting for the master to push
+// DoMap/DoReduce calls, it calls GetTask in a loop, executing whatever task
+// it's handed and reporting that task's result on the following call, until
+// the master reports the round done. Use this instead of Start when the
+// master is in PullMode; any number of workers may call it, independent of
+// the number of map or reduce tasks.
+func (w *Worker) StartPull() {
+	w.setup()
+
+	args := &GetTaskArgs{WorkerID: w.address}
+	for w.IsActive() {
+		var reply GetTaskReply
+		if !w.callMaster("ParallelMaster.GetTask", args, &reply) {
+			time.Sleep(pullPollInterval)
+			continue
+		}
+
+		switch reply.TaskType {
+		case "map":
+			a := reply.MapArgs
+			tempFiles := w.DoMap(a.InputFileName, a.MapperNum, a.NumReducers, codecByName(a.Codec))
+			atomic.AddInt32(&w.mapsDone, 1)
+			args = &GetTaskArgs{WorkerID: w.address, LastTaskType: "map", LastTaskID: int(a.MapperNum), LastMapFiles: tempFiles}
+		case "reduce":
+			a := reply.ReduceArgs
+			tempFile := w.DoReduce(a.ReducerNum, a.NumMappers, codecByName(a.Codec))
+			atomic.AddInt32(&w.reducesDone, 1)
+			args = &GetTaskArgs{WorkerID: w.address, LastTaskType: "reduce", LastTaskID: int(a.ReducerNum), LastReduceFile: tempFile}
+		case "done":
+			w.Shutdown()
+			return
+		default: // "wait"
+			time.Sleep(pullPollInterval)
+		}
+	}
+}
+
+// sendHeartbeats periodically reports this worker's liveness and progress
+// to the master so a hung or stuck worker can be detected and its task
+// reassigned. It stops once the worker is shut down.
+func (w *Worker) sendHeartbeats() {
+	for w.IsActive() {
+		args := &HeartbeatArgs{
+			WorkerAddress: w.address,
+			MapsDone:      uint(atomic.LoadInt32(&w.mapsDone)),
+			ReducesDone:   uint(atomic.LoadInt32(&w.reducesDone)),
+		}
+		w.callMaster("ParallelMaster.Heartbeat", args, new(interface{}))
+		time.Sleep(heartbeatInterval)
+	}
+}
+
 // Runs the user's mapper function on the given inputs. The key to the mapper
 // function will simply be the input filename, and the value will be the full
 // contents of that file. The key and value pairs returned from the user's map
-// function should be split into reduce tasks, serialized, and written out to
-// `numReducers` output files. Each key can be mapped to a reducer using the
-// `ihash` function modulo the number of reducers. The filename of the reducer
-// output file for a given job, from a given mapper, for a given reducer can be
-// determined using the `reduceInputName` function.
-func (w *Worker) DoMap(inputFileName string, mapperNum, numReducers uint) {
+// function should be split into reduce tasks and serialized into `numReducers`
+// uniquely-named temp files, one per reducer; the returned paths are the
+// final reduceInputName for a given mapper/reducer pair once the master
+// commits them. Writing to a fresh temp file rather than appending to the
+// final path means a task that gets re-executed after a crash or a missed
+// heartbeat can never duplicate records into a reducer's input. Each
+// partition is combined (if a combiner is registered) and sorted by key
+// before it's written, so the reduce side can merge per-mapper files with a
+// k-way merge instead of holding them all in memory. codec controls how
+// each partition is serialized to disk.
+func (w *Worker) DoMap(inputFileName string, mapperNum, numReducers uint, codec IntermediateCodec) []string {
 	fmt.Printf("MAP[%s:%d]: Processing '%s' for %d reducers.\n", w.jobName,
 		mapperNum, inputFileName, numReducers)
 
@@ -71,69 +174,180 @@ func (w *Worker) DoMap(inputFileName string, mapperNum, numReducers uint) {
 		partitions[reducerNum] = append(partitions[reducerNum], kv)
 	}
 
-	//save to files
+	//combine, sort, and save each partition to its own temp file
+	tempFiles := make([]string, numReducers)
 	for reducerNum, xPartition := range partitions {
-		outputFileName := reduceInputName(w.jobName, mapperNum, uint(reducerNum))
+		xPartition = w.applyCombiner(xPartition)
+		sort.Slice(xPartition, func(i, j int) bool { return xPartition[i].Key < xPartition[j].Key })
+
+		finalName := reduceInputName(w.jobName, mapperNum, uint(reducerNum))
+		dir, base := filepath.Split(finalName)
 
-		outputFile, err := os.OpenFile(outputFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0755)
-		checkErr(err, "[Map] Cannot open map output file:")
+		tempFile, err := ioutil.TempFile(dir, base+".tmp")
+		checkErr(err, "[Map] Cannot create temp map output file:")
 
-		enc := json.NewEncoder(outputFile)
+		kw := codec.NewWriter(tempFile)
 		for _, kv := range xPartition {
-			enc.Encode(kv)
+			kw.Write(kv)
+		}
+		checkErr(kw.Close(), "[Map] Cannot close temp map output file:")
+		tempFile.Close()
+
+		tempFiles[reducerNum] = tempFile.Name()
+	}
+
+	return tempFiles
+}
+
+// applyCombiner collapses duplicate keys within a single partition by
+// running the user's combiner over each key's values, shrinking shuffle
+// size before the partition ever reaches disk. It's a no-op if no combiner
+// is registered.
+func (w *Worker) applyCombiner(partition []KeyValue) []KeyValue {
+	if w.combinerF == nil {
+		return partition
+	}
+
+	grouped := make(map[string][]string)
+	order := make([]string, 0, len(partition))
+	for _, kv := range partition {
+		if _, seen := grouped[kv.Key]; !seen {
+			order = append(order, kv.Key)
 		}
-		outputFile.Close()
+		grouped[kv.Key] = append(grouped[kv.Key], kv.Value)
 	}
 
+	combined := make([]KeyValue, 0, len(order))
+	for _, key := range order {
+		combined = append(combined, KeyValue{key, w.combinerF(key, grouped[key])})
+	}
+	return combined
 }
 
-// Run's the user's reduce function on the given inputs. It does this by reading
-// in each mapper output intended for this reducer, deserializing the keys,
-// grouping together all of the values for a given key, and then passing the key
-// and list of values to the user's reduce function. The value output from the
-// user's reduce function should be coupled with the key, serialized, and
-// written out to the merger's input file, which can be obtained by calling the
-// `ReduceOutputName` function with the proper values.
-func (w *Worker) DoReduce(reducerNum, numMappers uint) {
+// Runs the user's reduce function on the given inputs. Since DoMap sorts
+// each partition by key before writing it, the numMappers per-mapper input
+// files for this reducer are each individually sorted; DoReduce merges them
+// with a k-way heap merge rather than loading them all into memory, and
+// streams each key's values to the user's reduce function through a
+// ValueIter so unbounded value lists never need to be materialized. The
+// output is written to a uniquely-named temp file; the master renames it
+// into place under ReduceOutputName once it commits the task, so a
+// re-executed reduce task can never leave a half-written or duplicated
+// output file behind. codec must be the same one DoMap used to write these
+// partitions.
+func (w *Worker) DoReduce(reducerNum, numMappers uint, codec IntermediateCodec) string {
 	fmt.Printf("REDUCE[%s:%d]: Reducing from %d mappers.\n", w.jobName,
 		reducerNum, numMappers)
 
-	//kvMap will keep all the key, val list
-	kvMap := make(map[string][]string)
-
-	// read from each mapper's output, each output is deserialized, and grouped together
+	sources := &kvSourceHeap{}
+	heap.Init(sources)
 	for mapNumber := uint(0); mapNumber < numMappers; mapNumber++ {
-		reducerInputFileName := reduceInputName(w.jobName, mapNumber, reducerNum)
-		file, err := os.Open(reducerInputFileName)
-		checkErr(err, "[Reduce] Cannot open input file :")
+		src := newKVSource(reduceInputName(w.jobName, mapNumber, reducerNum), codec)
+		if src.ok {
+			heap.Push(sources, src)
+		} else {
+			src.Close()
+		}
+	}
+
+	finalName := ReduceOutputName(w.jobName, reducerNum)
+	dir, base := filepath.Split(finalName)
+
+	tempFile, err := ioutil.TempFile(dir, base+".tmp")
+	checkErr(err, "[Reduce] Cannot create temp reducer output file :")
+	defer tempFile.Close()
+
+	kw := codec.NewWriter(tempFile)
+	for sources.Len() > 0 {
+		key := (*sources)[0].peek.Key
+		iter := &mergeValueIter{sources: sources, key: key}
 
-		decoder := json.NewDecoder(file)
+		result := w.reduceF(key, iter)
+		kw.Write(KeyValue{key, result})
 
-		var kv KeyValue
-		for err := decoder.Decode(&kv); err == nil; err = decoder.Decode(&kv) {
-			key := kv.Key
-			val := kv.Value
-			kvMap[key] = append(kvMap[key], val)
+		// Drain anything the reduce function didn't consume so the merge
+		// can move past this key.
+		for _, ok := iter.Next(); ok; _, ok = iter.Next() {
 		}
 	}
+	checkErr(kw.Close(), "[Reduce] Cannot close temp reducer output file :")
 
-	//Pass <Key, [Val]> into the reduce func, and stored
-	var opKvList []KeyValue
-	for key, vals := range kvMap {
-		opKvList = append(opKvList, KeyValue{key, w.reduceF(key, vals)})
-	}
+	return tempFile.Name()
+}
+
+// kvSource is one mapper's sorted intermediate input for this reducer. It
+// keeps the next undelivered record peeked so it can take part in a k-way
+// merge with the other mappers' sources.
+type kvSource struct {
+	file *os.File
+	dec  KVReader
+	peek KeyValue
+	ok   bool
+}
 
-	//get output name
-	rOutFileName := ReduceOutputName(w.jobName, reducerNum)
+func newKVSource(fileName string, codec IntermediateCodec) *kvSource {
+	file, err := os.Open(fileName)
+	checkErr(err, "[Reduce] Cannot open input file :")
+	s := &kvSource{file: file, dec: codec.NewReader(file)}
+	s.advance()
+	return s
+}
+
+// advance decodes the next record into peek, or sets ok to false once the
+// source is exhausted.
+func (s *kvSource) advance() {
+	s.ok = s.dec.Decode(&s.peek) == nil
+}
 
-	oFile, err := os.Create(rOutFileName)
-	checkErr(err, "[Reduce] Cannot create reducer output file :")
-	defer oFile.Close()
+func (s *kvSource) Close() {
+	s.file.Close()
+}
 
-	enc := json.NewEncoder(oFile)
-	for _, kv := range opKvList {
-		enc.Encode(kv)
+// kvSourceHeap is a min-heap of kvSources ordered by their peeked key. It
+// lets DoReduce merge numMappers sorted partitions in sorted order without
+// reading any of them fully into memory.
+type kvSourceHeap []*kvSource
+
+func (h kvSourceHeap) Len() int           { return len(h) }
+func (h kvSourceHeap) Less(i, j int) bool { return h[i].peek.Key < h[j].peek.Key }
+func (h kvSourceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *kvSourceHeap) Push(x interface{}) {
+	*h = append(*h, x.(*kvSource))
+}
+
+func (h *kvSourceHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// mergeValueIter streams the values for a single reduce key by repeatedly
+// popping the lowest-keyed source off the shared heap while its peeked key
+// still matches.
+type mergeValueIter struct {
+	sources *kvSourceHeap
+	key     string
+}
+
+// Next implements ValueIter.
+func (it *mergeValueIter) Next() (string, bool) {
+	if it.sources.Len() == 0 || (*it.sources)[0].peek.Key != it.key {
+		return "", false
 	}
+
+	src := (*it.sources)[0]
+	val := src.peek.Value
+	src.advance()
+	if src.ok {
+		heap.Fix(it.sources, 0)
+	} else {
+		heap.Pop(it.sources)
+		src.Close()
+	}
+	return val, true
 }
 
 // Shuts the worker down by shutting down the RPC server.
@@ -156,7 +370,7 @@ func (w *Worker) RegisterWithServer() {
 	// Try to register for 10 seconds.
 	ok := false
 	for i := 0; i < 40 && !ok; i++ {
-		ok = callMaster("Register", &RegisterArgs{w.address}, new(interface{}))
+		ok = w.callMaster("ParallelMaster.Register", &RegisterArgs{w.address}, new(interface{}))
 		if !ok {
 			time.Sleep(250 * time.Millisecond)
 			if (i % 10) == 0 {
@@ -182,20 +396,36 @@ type TaskArgs interface {
 type DoMapArgs struct {
 	InputFileName          string
 	MapperNum, NumReducers uint
+	Codec                  string
 }
 
 type DoReduceArgs struct {
 	ReducerNum, NumMappers uint
+	Codec                  string
+}
+
+// DoMapReply carries back the temp files DoMap wrote its partitions to, one
+// per reducer, for the master to commit or discard.
+type DoMapReply struct {
+	TempFiles []string
+}
+
+// DoReduceReply carries back the temp file DoReduce wrote its output to, for
+// the master to commit or discard.
+type DoReduceReply struct {
+	TempFile string
 }
 
-func (w *RPCWorker) DoMap(args *DoMapArgs, reply *interface{}) error {
-	(*Worker)(w).DoMap(args.InputFileName, args.MapperNum, args.NumReducers)
+func (w *RPCWorker) DoMap(args *DoMapArgs, reply *DoMapReply) error {
+	codec := codecByName(args.Codec)
+	reply.TempFiles = (*Worker)(w).DoMap(args.InputFileName, args.MapperNum, args.NumReducers, codec)
 	atomic.AddInt32(&(*Worker)(w).mapsDone, 1)
 	return nil
 }
 
-func (w *RPCWorker) DoReduce(args *DoReduceArgs, reply *interface{}) error {
-	(*Worker)(w).DoReduce(args.ReducerNum, args.NumMappers)
+func (w *RPCWorker) DoReduce(args *DoReduceArgs, reply *DoReduceReply) error {
+	codec := codecByName(args.Codec)
+	reply.TempFile = (*Worker)(w).DoReduce(args.ReducerNum, args.NumMappers, codec)
 	atomic.AddInt32(&(*Worker)(w).reducesDone, 1)
 	return nil
 }
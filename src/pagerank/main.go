@@ -9,10 +9,8 @@ import (
 	mr "mapreduce"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
-	"time"
 )
 
 const (
@@ -68,22 +66,22 @@ func calculatePR(pr string, L int) string {
 	return strconv.FormatFloat(val/float64(L), 'f', -1, 64)
 }
 
-// The reduce function is called once for each key generated by Map, with a list
-// of that key's string value (merged across all inputs). The return value
-// should be a single output value for that key.
+// The reduce function is called once for each key generated by Map, with a
+// streamed iterator over that key's values (merged across all inputs). The
+// return value should be a single output value for that key.
 // Input: Key - v(outpage) , Values PRs from each p
 // Output: sum(PRs)
-func reduceF(key string, values []string) (res string) {
+func reduceF(key string, values mr.ValueIter) (res string) {
 	newPr := reducePRs(values)
 	res = strconv.FormatFloat(newPr, 'f', -1, 64)
 	return
 }
 
 //reducePRs sums all the PRs for a specific page.
-func reducePRs(values []string) float64 {
+func reducePRs(values mr.ValueIter) float64 {
 	var sumPr float64
 
-	for _, valstr := range values {
+	for valstr, ok := values.Next(); ok; valstr, ok = values.Next() {
 		val, err := strconv.ParseFloat(valstr, 64)
 		checkErr(err, "Failed to parse value at reduceF: ", valstr)
 
@@ -95,8 +93,6 @@ func reducePRs(values []string) float64 {
 
 // Parses the command line arguments and runs the computation.
 func main() {
-
-	// Some useful code, to get started:
 	jobName := "pagerank"
 	numIterations := 10
 
@@ -108,36 +104,22 @@ func main() {
 	//Copy inputs into a /tmp folder which will be modifed by each iteration
 	inputFileNames = copyInputs(inputFileNames)
 
-	// numMappers equal to numInputFiles
-	numMappers := len(inputFileNames)
-
-	done := make(chan bool)
-	for i := 0; i < numIterations; i++ {
-		//Set Up
-		master := mr.NewParallelMaster(jobName, inputFileNames, reducers, mapF, reduceF)
-		setupMaster(master, done)
-		registerWorkers(numMappers, jobName, done)
-
-		tempOutputFile := master.Merge()
-		//Update input files
-		updateInputs(inputFileNames, tempOutputFile, pageLinks)
-		cleanUp(jobName, int(reducers), numMappers)
-	}
+	job := mr.NewIterativeJob(jobName, inputFileNames, reducers, mapF, reduceF,
+		func(ctx mr.JobContext, prevOutputFile string, iteration int) []string {
+			updateInputs(inputFileNames, prevOutputFile, ctx["pageLinks"].(map[string]string))
+			return inputFileNames
+		},
+		func(ctx mr.JobContext, iteration int, prevOutputFile string) bool {
+			return iteration == numIterations-1
+		})
+	job.Context["pageLinks"] = pageLinks
+	job.Run()
 
 	//Clean up copied inputs
 	err := os.RemoveAll(fmt.Sprintf("%stmp/", mr.DataOutputDir))
 	checkErr(err, "Failed to remove temporary data input folder")
 }
 
-//setupMaster sets up a ParallelMaster
-//Credit to Sergio
-func setupMaster(master *mr.ParallelMaster, done chan bool) {
-	go func() {
-		master.Start()
-		done <- true
-	}()
-}
-
 //copyInputs copy the input files into a /tmp folder in the data output dir.
 //It returns the modifled input file names
 func copyInputs(fNames []string) []string {
@@ -168,24 +150,6 @@ func inputCopyName(o string) string {
 	return fmt.Sprintf("%stmp/%s", mr.DataOutputDir, fileN)
 }
 
-//registerWorkers register numMappers of workers
-//Ack: Based on test_test.go
-func registerWorkers(numMappers int, job string, done chan bool) {
-
-	// Make sure the master (probably) sets up so workers can register quickly.
-	runtime.Gosched()
-	time.Sleep(100 * time.Millisecond)
-	runtime.Gosched()
-
-	workers := make([]*mr.Worker, 0, numMappers)
-	for i := 0; i < numMappers; i++ {
-		worker := mr.NewWorker(job, mapF, reduceF)
-		workers = append(workers, worker)
-		go worker.Start()
-	}
-	<-done
-}
-
 //processLinks parsed the outbound links of each page and store them in a map
 //This is to faciliate the process of updating intermediary inputs so that
 //only the PRs of each page needs to be read.
@@ -249,25 +213,6 @@ func updateInputs(inputFileNames []string, tempOutputFile string, pageLinks map[
 	}
 }
 
-//cleanUp cleans up each mapper's output files after one iteration.
-func cleanUp(jobName string, numReducers, numMappers int) {
-	//Clean up temporary mapper output
-	for i := 0; i < numReducers; i++ {
-		for k := 0; k < numMappers; k++ {
-			fN := reduceInputName(jobName, k, i)
-			err := os.Truncate(fN, 0)
-			checkErr(err, "Cannot Truncate file : ", fN)
-		}
-	}
-}
-
-//reduceInputName is a copy of the private method in the mr package
-func reduceInputName(jobName string, mapperNum, reducerNum int) string {
-	return mr.DataOutputDir + "mr." + jobName + "-" +
-		strconv.Itoa(mapperNum) + "-" + strconv.Itoa(reducerNum)
-
-}
-
 //checkErr is A convenience function. Checks whether some error is nil. If it not, i.e.,
 // there is an error, panics with the error along with the message `msg`.
 func checkErr(err error, msg ...string) {